@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// frameHeaderSize is the per-frame uint32 length prefix packed ahead of each
+// frame's payload within a block.
+const frameHeaderSize = 4
+
+// Block status values, mirroring TPACKET_V3's TP_STATUS_KERNEL (still being
+// filled by the producer) and TP_STATUS_USER (retired, ready for the
+// consumer to iterate).
+const (
+	blockOwnedByProducer uint32 = 0
+	blockRetired         uint32 = 1
+)
+
+// blockHeader is the per-block metadata TPACKET_V3 stores at the start of
+// each block. status is the single flag the producer uses to publish the
+// rest of the header (numPkts, offsetFirstPkt, seqNum) to the consumer,
+// which must not read them until it observes blockRetired. claimed and
+// completed are scoped to this block (rather than the ring as a whole) so
+// they can be reset independently each time the block cycles back to the
+// producer: claimed is the number of claim attempts so far (frame slots
+// reserved, including ones still being written, plus any attempts past
+// framesPerBlock that found the block full), and completed is the number of
+// reserved slots that have actually
+// finished writing, which is what retirement must wait for before exposing
+// the block to the consumer.
+type blockHeader struct {
+	status         atomic.Uint32
+	claimed        atomic.Uint32
+	completed      atomic.Uint32
+	numPkts        uint32
+	offsetFirstPkt uint32
+	seqNum         uint64
+}
+
+// BlockRingOptions configures a BlockRingBuffer.
+type BlockRingOptions struct {
+	BlockSize    uint32        // Bytes per block, including its header
+	NumBlocks    uint32        // Number of blocks in the ring
+	FrameSize    uint32        // Bytes reserved per frame, including its length prefix
+	BlockTimeout time.Duration // Retire a partially-filled block once it has been open this long
+}
+
+// BlockRingBuffer packs many small frames into TPACKET_V3-style blocks
+// instead of publishing each record through its own atomic index update.
+// Producers pack frames into the current block; it is retired (made visible
+// to the consumer) either when it fills up or when BlockTimeout elapses
+// since it was first opened. Both checks run only inside PutFrame: a full
+// block is retired by the next PutFrame call that finds no free slot, and a
+// timed-out one by the next PutFrame call after BlockTimeout; there is no
+// background timer, so a block with no later PutFrame call is not retired.
+// This amortizes synchronization cost across a
+// whole block's worth of frames, which matters for packet-capture-like
+// workloads where per-record atomic updates otherwise dominate.
+type BlockRingBuffer struct {
+	region []byte // Caller-owned backing storage, typically an mmap'd shared-memory region
+	opts   BlockRingOptions
+
+	headerSize     uint32
+	framesPerBlock uint32
+
+	curBlock    atomic.Uint32 // Index of the block producers are currently packing
+	curSeq      atomic.Uint64
+	curOpenedAt atomic.Int64 // UnixNano when curBlock was first opened, for BlockTimeout
+
+	nextRead atomic.Uint32 // Next block index NextBlock should check for retirement
+}
+
+// NewBlockRingBuffer builds a BlockRingBuffer over region, which must be
+// exactly BlockSize*NumBlocks bytes (typically the mmap'd backing of a
+// shared-memory segment, sized by the caller the same way
+// NewSharedAtomicRingBuffer sizes its own mapping).
+func NewBlockRingBuffer(region []byte, opts BlockRingOptions) (*BlockRingBuffer, error) {
+	if opts.BlockSize == 0 || opts.NumBlocks == 0 || opts.FrameSize == 0 {
+		return nil, fmt.Errorf("sharedmem: BlockSize, NumBlocks and FrameSize must all be nonzero")
+	}
+	headerSize := uint32(unsafe.Sizeof(blockHeader{}))
+	if opts.FrameSize <= frameHeaderSize {
+		return nil, fmt.Errorf("sharedmem: FrameSize must exceed the %d-byte frame header", frameHeaderSize)
+	}
+	framesPerBlock := (opts.BlockSize - headerSize) / opts.FrameSize
+	if framesPerBlock == 0 {
+		return nil, fmt.Errorf("sharedmem: BlockSize %d too small to hold any frames of FrameSize %d", opts.BlockSize, opts.FrameSize)
+	}
+	if want := uint64(opts.BlockSize) * uint64(opts.NumBlocks); uint64(len(region)) != want {
+		return nil, fmt.Errorf("sharedmem: region is %d bytes, want BlockSize*NumBlocks = %d", len(region), want)
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = 100 * time.Millisecond
+	}
+
+	br := &BlockRingBuffer{
+		region:         region,
+		opts:           opts,
+		headerSize:     headerSize,
+		framesPerBlock: framesPerBlock,
+	}
+	br.curOpenedAt.Store(time.Now().UnixNano())
+	return br, nil
+}
+
+// block returns the raw bytes of the blockIdx'th block, header included.
+func (br *BlockRingBuffer) block(blockIdx uint32) []byte {
+	start := uint64(blockIdx) * uint64(br.opts.BlockSize)
+	return br.region[start : start+uint64(br.opts.BlockSize)]
+}
+
+// header returns the blockHeader at the start of the blockIdx'th block.
+func (br *BlockRingBuffer) header(blockIdx uint32) *blockHeader {
+	return (*blockHeader)(unsafe.Pointer(&br.block(blockIdx)[0]))
+}
+
+// frameSlot returns the FrameSize-wide slot reserved for the frame'th frame
+// of the blockIdx'th block.
+func (br *BlockRingBuffer) frameSlot(blockIdx, frame uint32) []byte {
+	start := uint64(br.headerSize) + uint64(frame)*uint64(br.opts.FrameSize)
+	b := br.block(blockIdx)
+	return b[start : start+uint64(br.opts.FrameSize)]
+}
+
+// PutFrame packs payload into the current block, retiring it first if it has
+// timed out and retiring (and advancing past) it if it's already full.
+func (br *BlockRingBuffer) PutFrame(payload []byte) error {
+	if len(payload) > int(br.opts.FrameSize)-frameHeaderSize {
+		return fmt.Errorf("sharedmem: frame of %d bytes exceeds the %d-byte FrameSize capacity", len(payload), br.opts.FrameSize-frameHeaderSize)
+	}
+	for {
+		blockIdx := br.curBlock.Load()
+		hdr := br.header(blockIdx)
+		if br.blockTimedOut(blockIdx) {
+			claimed := hdr.claimed.Load()
+			if claimed > br.framesPerBlock {
+				claimed = br.framesPerBlock // Overflow attempts past a full block reserved no slot
+			}
+			br.retireCurrent(blockIdx, claimed)
+			continue
+		}
+		frame := hdr.claimed.Add(1) - 1
+		if frame >= br.framesPerBlock {
+			br.retireCurrent(blockIdx, br.framesPerBlock)
+			continue
+		}
+		slot := br.frameSlot(blockIdx, frame)
+		binary.LittleEndian.PutUint32(slot, uint32(len(payload)))
+		copy(slot[frameHeaderSize:], payload)
+
+		if frame == 0 {
+			hdr.offsetFirstPkt = br.headerSize
+		}
+		atomic.AddUint32(&hdr.numPkts, 1)
+		hdr.completed.Add(1) // Publishes that this frame's write is done, for retireCurrent's barrier
+		return nil
+	}
+}
+
+// blockTimedOut reports whether blockIdx has both at least one packed frame
+// and has been open longer than BlockTimeout, meaning it should be retired
+// even though it isn't full.
+func (br *BlockRingBuffer) blockTimedOut(blockIdx uint32) bool {
+	hdr := br.header(blockIdx)
+	if atomic.LoadUint32(&hdr.numPkts) == 0 {
+		return false
+	}
+	openedAt := time.Unix(0, br.curOpenedAt.Load())
+	return time.Since(openedAt) >= br.opts.BlockTimeout
+}
+
+// retireCurrent publishes block idx to the consumer and advances production
+// to the next block in the ring, once it's safe to do so on both ends:
+//
+//   - It spins until the next block's status is blockOwnedByProducer, i.e.
+//     the consumer has actually released it via NextBlock's callback. Without
+//     this, a lagging consumer can have a block silently overwritten (and
+//     possibly still be iterating it) once the producer wraps all the way
+//     around NumBlocks.
+//   - The CAS on curBlock ensures that when multiple producers race to
+//     retire the same block (one over a full claim, others via timeout),
+//     only one performs the transition; everyone else returns immediately.
+//   - After winning the CAS it spins until completed reaches wantCompleted,
+//     the number of frames actually claimed in idx. This is the barrier that
+//     ties "every claimed frame finished writing" to "safe to expose the
+//     block": the CAS alone only proves a claim was made, not that the
+//     producer holding it has copied its payload and bumped numPkts yet.
+func (br *BlockRingBuffer) retireCurrent(idx, wantCompleted uint32) {
+	next := (idx + 1) % br.opts.NumBlocks
+	nextHdr := br.header(next)
+	for nextHdr.status.Load() != blockOwnedByProducer {
+		SpinWait(5 * time.Microsecond)
+	}
+	if !br.curBlock.CompareAndSwap(idx, next) {
+		return // Another producer already retired this block
+	}
+	hdr := br.header(idx)
+	for hdr.completed.Load() < wantCompleted {
+		SpinWait(time.Microsecond)
+	}
+	atomic.StoreUint64(&hdr.seqNum, br.curSeq.Add(1))
+	hdr.status.Store(blockRetired) // Publishes numPkts/offsetFirstPkt/seqNum to the consumer
+	br.curOpenedAt.Store(time.Now().UnixNano())
+}
+
+// NextBlock blocks until the next block in sequence has been retired, then
+// returns its raw bytes (header followed by its packed frames) along with a
+// release callback. The caller must call the callback once it's done
+// reading, which flips the block back to producer-owned so the ring can
+// reuse it.
+func (br *BlockRingBuffer) NextBlock() ([]byte, func()) {
+	idx := br.nextRead.Load()
+	hdr := br.header(idx)
+	for hdr.status.Load() != blockRetired {
+		SpinWait(5 * time.Microsecond)
+	}
+	br.nextRead.Store((idx + 1) % br.opts.NumBlocks)
+
+	block := br.block(idx)
+	release := func() {
+		hdr.offsetFirstPkt = 0
+		atomic.StoreUint32(&hdr.numPkts, 0)
+		hdr.claimed.Store(0)
+		hdr.completed.Store(0)
+		hdr.status.Store(blockOwnedByProducer)
+	}
+	return block, release
+}
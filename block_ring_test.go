@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// TestBlockRingProducerConsumerBackpressure runs more producers and frames
+// than the ring has room for in one pass around NumBlocks, so every block
+// gets reused multiple times. If a producer ever overwrote a block before
+// the consumer released it, a frame would either be silently destroyed
+// (making the consumer stall short of want) or its bytes would be torn
+// mid-write (making the payload decode to something other than what was
+// written). A final sentinel frame flushes out whichever block was still
+// open when the producers stopped, since retirement is only evaluated from
+// inside PutFrame.
+func TestBlockRingProducerConsumerBackpressure(t *testing.T) {
+	const (
+		numBlocks     = 4
+		framesPerBlk  = 8
+		frameSize     = 32
+		framesPerProd = numBlocks * framesPerBlk * 3 // several full trips around the ring
+		producers     = 4
+	)
+	headerSize := uint32(unsafe.Sizeof(blockHeader{}))
+	blockSize := headerSize + frameSize*framesPerBlk
+	region := make([]byte, uint64(blockSize)*numBlocks)
+
+	br, err := NewBlockRingBuffer(region, BlockRingOptions{
+		BlockSize:    blockSize,
+		NumBlocks:    numBlocks,
+		FrameSize:    frameSize,
+		BlockTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewBlockRingBuffer: %v", err)
+	}
+
+	want := producers * framesPerProd
+	var seenMu sync.Mutex
+	seen := make(map[uint32]bool)
+	done := make(chan struct{})
+
+	// The consumer must run concurrently with the producers, not after: the
+	// ring only has room for NumBlocks*framesPerBlk frames in flight, so
+	// producers would deadlock in retireCurrent waiting for a block release
+	// that never comes if nothing is draining yet.
+	go func() {
+		for {
+			seenMu.Lock()
+			n := len(seen)
+			seenMu.Unlock()
+			if n >= want {
+				close(done)
+				return
+			}
+			block, release := br.NextBlock()
+			hdr := (*blockHeader)(unsafe.Pointer(&block[0]))
+			numPkts := hdr.numPkts
+			seenMu.Lock()
+			for f := uint32(0); f < numPkts; f++ {
+				start := uint64(headerSize) + uint64(f)*frameSize
+				length := uint64(binary.LittleEndian.Uint32(block[start : start+4]))
+				val := binary.LittleEndian.Uint32(block[start+4 : start+4+length])
+				seen[val] = true
+			}
+			seenMu.Unlock()
+			release()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(producers)
+	for p := 0; p < producers; p++ {
+		p := p
+		go func() {
+			defer wg.Done()
+			for i := 0; i < framesPerProd; i++ {
+				payload := make([]byte, 4)
+				binary.LittleEndian.PutUint32(payload, uint32(p*framesPerProd+i))
+				if err := br.PutFrame(payload); err != nil {
+					t.Errorf("PutFrame: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	// A block that fills exactly to framesPerBlk retires on the next claim
+	// attempt that overflows it; one that's left partially full retires on
+	// the next timed-out PutFrame call. Either way, retirement is only
+	// re-checked from inside PutFrame, so once the producers above stop,
+	// whatever block is current needs one more call past BlockTimeout to
+	// flush it out to the consumer. That flush call's own frame lands in a
+	// new current block that, by the same lazy-retirement rule, never
+	// retires either — so it's a disposable sentinel, not counted in want.
+	const flushSentinel = ^uint32(0)
+	wg.Wait()
+	time.Sleep(2 * br.opts.BlockTimeout)
+	flushPayload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flushPayload, flushSentinel)
+	if err := br.PutFrame(flushPayload); err != nil {
+		t.Fatalf("flush PutFrame: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		seenMu.Lock()
+		n := len(seen)
+		seenMu.Unlock()
+		t.Fatalf("consumer stalled: got %d/%d distinct frames, ring never caught up (producer likely overwrote a block the consumer hadn't released)", n, want)
+	}
+
+	if len(seen) != want {
+		t.Fatalf("got %d distinct frames, want %d", len(seen), want)
+	}
+}
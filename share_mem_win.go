@@ -1,9 +1,10 @@
+//go:build windows
+
 package main
 
 import (
 	"fmt"
 	"log"
-	"runtime"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -11,20 +12,58 @@ import (
 	"golang.org/x/sys/windows"
 )
 
-const (
-	bufferSize = 1024 // Size of the ring buffer
+var (
+	kernel32             = windows.NewLazySystemDLL("kernel32.dll")
+	procWaitOnAddress    = kernel32.NewProc("WaitOnAddress")
+	procWakeByAddressAll = kernel32.NewProc("WakeByAddressAll")
 )
 
-// SharedAtomicRingBuffer represents a shared atomic ring buffer
+// SharedAtomicRingBuffer represents a shared atomic ring buffer. Fields are
+// laid out as {buffer, pad, writeIdx, pad, readIdx, pad, rawBuffer, pad,
+// rawWriteIdx, pad, rawReadIdx, pad} so every hot index owns its own cache
+// line: without the padding, writeIdx and readIdx sit 8 bytes apart and
+// every producer store invalidates the consumer's line (and vice versa),
+// which guts SPSC throughput.
 type SharedAtomicRingBuffer struct {
-	buffer   [bufferSize]atomic.Uint64 // Shared buffer
-	writeIdx atomic.Uint64             // Write index
-	readIdx  atomic.Uint64             // Read index
-	addr     uintptr                   // Base address of the shared memory
+	buffer [bufferSize]mpmcSlot // Shared buffer
+	_      CacheLinePad
+	writeIdx atomic.Uint64 // Next write ticket
+	_        uint64CacheLinePad
+	readIdx  atomic.Uint64 // Next read ticket
+	_        CacheLinePad
+
+	rawBuffer [rawBufferSize]byte // Shared region for variable-length records
+	_         uint64CacheLinePad
+	rawWriteIdx atomic.Uint64 // Monotonic byte offset of the next slot to reserve
+	_           uint64CacheLinePad
+	rawReadIdx  atomic.Uint64 // Monotonic byte offset of the next slot to read
+	_           CacheLinePad
+
+	addr           uintptr       // Base address of the shared memory, set once at construction
+	producers      int           // >1 selects the CAS-guarded MPMC protocol for Write
+	consumers      int           // >1 selects the CAS-guarded MPMC protocol for Read
+	spinBeforePark time.Duration // How long WriteBlocking/ReadBlocking spin before parking
 }
 
-// NewSharedAtomicRingBuffer creates a new shared atomic ring buffer
-func NewSharedAtomicRingBuffer(name string) (*SharedAtomicRingBuffer, error) {
+// NewSharedAtomicRingBuffer creates a new shared atomic ring buffer. opts is
+// variadic so existing single-producer/single-consumer callers are unaffected;
+// passing an Options value with Producers or Consumers above 1 switches Write
+// or Read, respectively, into MPMC mode.
+func NewSharedAtomicRingBuffer(name string, opts ...Options) (*SharedAtomicRingBuffer, error) {
+	o := Options{Producers: 1, Consumers: 1}
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Producers < 1 {
+		o.Producers = 1
+	}
+	if o.Consumers < 1 {
+		o.Consumers = 1
+	}
+	if o.SpinBeforePark <= 0 {
+		o.SpinBeforePark = defaultSpinBeforePark
+	}
+
 	// Create a file mapping object
 	fileMapping, err := windows.CreateFileMapping(
 		windows.InvalidHandle, // Use the paging file
@@ -37,6 +76,9 @@ func NewSharedAtomicRingBuffer(name string) (*SharedAtomicRingBuffer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file mapping: %v", err)
 	}
+	// If a mapping with this name already exists, another process owns the
+	// live slot sequence numbers and we must not re-seed them.
+	alreadyExists := windows.GetLastError() == windows.ERROR_ALREADY_EXISTS
 
 	// Map the file mapping into the process's address space
 	const FILE_MAP_ALL_ACCESS = windows.FILE_MAP_WRITE | windows.FILE_MAP_READ
@@ -54,52 +96,47 @@ func NewSharedAtomicRingBuffer(name string) (*SharedAtomicRingBuffer, error) {
 
 	// Convert the address to a SharedAtomicRingBuffer
 	ringBuffer := (*SharedAtomicRingBuffer)(unsafe.Pointer(addr))
+	if err := assertCacheLineAligned(ringBuffer); err != nil {
+		windows.UnmapViewOfFile(addr)
+		windows.CloseHandle(fileMapping)
+		return nil, err
+	}
+	ringBuffer.addr = addr
+	ringBuffer.producers = o.Producers
+	ringBuffer.consumers = o.Consumers
+	ringBuffer.spinBeforePark = o.SpinBeforePark
+	if !alreadyExists {
+		for i := range ringBuffer.buffer {
+			ringBuffer.buffer[i].seq.Store(uint64(i))
+		}
+	}
 
 	return ringBuffer, nil
 }
 
-// SpinWait performs a low-latency CPU spin loop for the given duration
-func SpinWait(duration time.Duration) {
-	start := time.Now()
-	for time.Since(start) < duration {
-		runtime.Gosched() // Yield CPU to reduce contention
-	}
-}
-
 // Close releases the shared memory resources
 func (rb *SharedAtomicRingBuffer) Close() {
 	windows.UnmapViewOfFile(rb.addr)
 }
 
-// Write writes a value to the ring buffer
-func (rb *SharedAtomicRingBuffer) Write(value uint64) bool {
-	writeIdx := rb.writeIdx.Load()
-	nextWriteIdx := (writeIdx + 1) % bufferSize
-
-	// Check if the buffer is full
-	if nextWriteIdx == rb.readIdx.Load() {
-		SpinWait(5 * time.Microsecond)
-	}
-
-	// Write the value
-	rb.buffer[writeIdx].Store(value)
-	rb.writeIdx.Store(nextWriteIdx)
-	return true
+// parkWait blocks while *word still equals expect, or until woken by
+// parkWake on the same address. Unlike a futex, WaitOnAddress takes the size
+// of the compared value in bytes rather than an opcode.
+func parkWait(word *int32, expect int32) {
+	procWaitOnAddress.Call(
+		uintptr(unsafe.Pointer(word)),
+		uintptr(unsafe.Pointer(&expect)),
+		unsafe.Sizeof(expect),
+		uintptr(windows.INFINITE),
+	)
 }
 
-// Read reads a value from the ring buffer
-func (rb *SharedAtomicRingBuffer) Read() (uint64, bool) {
-	readIdx := rb.readIdx.Load()
-
-	// Check if the buffer is empty
-	for readIdx == rb.writeIdx.Load() {
-		SpinWait(1 * time.Microsecond)
-	}
-
-	// Read the value
-	value := rb.buffer[readIdx].Load()
-	rb.readIdx.Store((readIdx + 1) % bufferSize)
-	return value, true
+// parkWake wakes every waiter parked on word via parkWait. In MPMC mode,
+// multiple goroutines can be parked on the same word (&writeIdx or &readIdx)
+// waiting on different slots becoming ready; WakeByAddressSingle would wake
+// an arbitrary one, possibly the wrong one, leaving the rest asleep forever.
+func parkWake(word *int32) {
+	procWakeByAddressAll.Call(uintptr(unsafe.Pointer(word)))
 }
 
 func main() {
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// This file holds everything about SharedAtomicRingBuffer that doesn't touch
+// an OS-specific API: the MPMC slot protocol, cache-line padding, the
+// variable-length record framing, and blocking reads/writes built on top of
+// a platform-supplied park/wake primitive. shared_mem_posix.go and
+// share_mem_win.go each keep only the struct definition, the mmap/FileMapping
+// setup, the syscalls (futex vs. WaitOnAddress) that genuinely differ per OS,
+// and a demo main; keeping
+// everything else here means the two platforms can't silently drift apart
+// the way writeSPSC once did.
+
+const (
+	bufferSize = 1024 // Size of the ring buffer
+
+	rawBufferSize = 64 * 1024 // Size of the variable-length record region, must be a power of two
+	headerSize    = 8         // recordHeader{Len uint32; Flags uint32} packed into one atomic word
+
+	recordBusy    = uint64(1) << 63 // Flags high bit: producer is still copying the payload
+	recordDiscard = uint64(1) << 62 // Flags next bit: slot was abandoned, reader should skip it
+)
+
+// errBusy is returned by ReadRecord when the next record's header still has the
+// busy bit set, meaning the producer has reserved the slot but not committed it yet.
+var errBusy = errors.New("sharedmem: record is still being written")
+
+// errEmpty is returned by ReadRecord when the reader has caught up with the writer.
+var errEmpty = errors.New("sharedmem: no record available")
+
+// align8 rounds n up to the next multiple of 8 so every record header lands on an
+// address the atomic package can load/store as a single word.
+func align8(n int) int {
+	return (n + 7) &^ 7
+}
+
+// mpmcSlot is one entry of the fixed-size ring in Vyukov's bounded MPMC queue
+// style: seq lets producers and consumers agree on slot ownership without a
+// single shared writeIdx/readIdx being the sole arbiter.
+type mpmcSlot struct {
+	seq atomic.Uint64
+	val atomic.Uint64
+}
+
+// CacheLinePad separates hot atomic fields so each lands on its own cache
+// line. It's sized for the widest line this package targets (128 bytes on
+// Apple Silicon) so it's always sufficient, even though cacheLineSize can
+// detect a narrower line (64 bytes on x86 and most other arm64 systems).
+type CacheLinePad [128]byte
+
+// uint64CacheLinePad is CacheLinePad shrunk by the 8 bytes of the
+// atomic.Uint64 it immediately follows. CacheLinePad alone reserves a full
+// line but doesn't account for the field in front of it, so stacking
+// {atomic.Uint64, CacheLinePad} repeatedly drifts the next hot field 8 bytes
+// off every boundary it crosses; this variant keeps the running offset a
+// multiple of the line size instead.
+type uint64CacheLinePad [120]byte
+
+// cacheLineSize returns the L1 cache line size for the current architecture,
+// matching Go's internal cpu.CacheLineSize tables: 128 bytes on Apple
+// Silicon, 64 bytes everywhere else this package targets.
+func cacheLineSize() int {
+	if runtime.GOARCH == "arm64" && runtime.GOOS == "darwin" {
+		return 128
+	}
+	return 64
+}
+
+// assertCacheLineAligned verifies that writeIdx, readIdx, rawWriteIdx and
+// rawReadIdx each start on a cache-line boundary of the mapped struct. A
+// mapping that fails this (e.g. because mmap/MapViewOfFile handed back an
+// address whose alignment doesn't match the padding this struct was built
+// with) would silently reintroduce false sharing, so it's treated as a hard
+// error.
+func assertCacheLineAligned(rb *SharedAtomicRingBuffer) error {
+	line := uintptr(cacheLineSize())
+	base := uintptr(unsafe.Pointer(rb))
+	fields := map[string]uintptr{
+		"writeIdx":    unsafe.Offsetof(rb.writeIdx),
+		"readIdx":     unsafe.Offsetof(rb.readIdx),
+		"rawWriteIdx": unsafe.Offsetof(rb.rawWriteIdx),
+		"rawReadIdx":  unsafe.Offsetof(rb.rawReadIdx),
+	}
+	for name, off := range fields {
+		if (base+off)%line != 0 {
+			return fmt.Errorf("sharedmem: mapped address breaks %d-byte cache-line alignment at field %s (offset %d)", line, name, off)
+		}
+	}
+	return nil
+}
+
+// defaultSpinBeforePark is how long WriteBlocking/ReadBlocking busy-spin
+// before parking, so a buffer that's hot for only a few microseconds never
+// pays the syscall cost of a park/wake round trip.
+const defaultSpinBeforePark = 1 * time.Microsecond
+
+// Options configures how a SharedAtomicRingBuffer is shared. The zero value
+// (treated as Producers: 1, Consumers: 1) keeps the original single-producer/
+// single-consumer fast path, which stores indices unconditionally and never
+// needs a CAS. Producers above 1 switches Write to the CAS-guarded ticket
+// protocol and Consumers above 1 does the same for Read; that protocol is the
+// only mode safe when multiple processes map the same segment and call
+// Write/Read concurrently.
+type Options struct {
+	Producers int
+	Consumers int
+
+	// SpinBeforePark is how long WriteBlocking/ReadBlocking busy-spin before
+	// parking. Zero selects defaultSpinBeforePark.
+	SpinBeforePark time.Duration
+}
+
+// SpinWait performs a low-latency CPU spin loop for the given duration
+func SpinWait(duration time.Duration) {
+	start := time.Now()
+	for time.Since(start) < duration {
+		runtime.Gosched() // Yield CPU to reduce contention
+	}
+}
+
+// Write writes a value to the ring buffer
+func (rb *SharedAtomicRingBuffer) Write(value uint64) bool {
+	if rb.producers <= 1 {
+		return rb.writeSPSC(value)
+	}
+	return rb.writeMPMC(value)
+}
+
+// writeSPSC is the original single-producer fast path: it owns writeIdx
+// outright, so it only needs to wait for the consumer to free the slot before
+// storing, with no CAS on the shared index.
+func (rb *SharedAtomicRingBuffer) writeSPSC(value uint64) bool {
+	t := rb.writeIdx.Load()
+	slot := &rb.buffer[t%bufferSize]
+	for slot.seq.Load() != t {
+		SpinWait(5 * time.Microsecond)
+	}
+	slot.val.Store(value)
+	slot.seq.Store(t + 1)
+	rb.writeIdx.Store(t + 1)
+	return true
+}
+
+// writeMPMC implements Vyukov's bounded MPMC queue: a producer claims ticket
+// t by CAS-ing writeIdx forward, spins until slot[t%N].seq == t confirms the
+// consumer has vacated it, writes the value, then publishes with seq = t+1.
+func (rb *SharedAtomicRingBuffer) writeMPMC(value uint64) bool {
+	for {
+		t := rb.writeIdx.Load()
+		slot := &rb.buffer[t%bufferSize]
+		seq := slot.seq.Load()
+		switch {
+		case seq == t:
+			if rb.writeIdx.CompareAndSwap(t, t+1) {
+				slot.val.Store(value)
+				slot.seq.Store(t + 1)
+				return true
+			}
+		case seq < t:
+			SpinWait(5 * time.Microsecond) // Buffer full; wait for a consumer to catch up
+		default:
+			// Another producer already claimed this ticket; reload and retry.
+		}
+	}
+}
+
+// Read reads a value from the ring buffer
+func (rb *SharedAtomicRingBuffer) Read() (uint64, bool) {
+	if rb.consumers <= 1 {
+		return rb.readSPSC()
+	}
+	return rb.readMPMC()
+}
+
+// readSPSC is the original single-consumer fast path: it owns readIdx
+// outright, so it only needs to wait for the producer to publish the slot
+// before loading, with no CAS on the shared index.
+func (rb *SharedAtomicRingBuffer) readSPSC() (uint64, bool) {
+	t := rb.readIdx.Load()
+	slot := &rb.buffer[t%bufferSize]
+	for slot.seq.Load() != t+1 {
+		SpinWait(1 * time.Microsecond)
+	}
+	value := slot.val.Load()
+	slot.seq.Store(t + bufferSize)
+	rb.readIdx.Store(t + 1)
+	return value, true
+}
+
+// readMPMC mirrors writeMPMC: a consumer claims ticket t by CAS-ing readIdx
+// forward, spins until slot[t%N].seq == t+1 confirms a producer has published
+// it, loads the value, then frees the slot for a future writer with
+// seq = t+N.
+func (rb *SharedAtomicRingBuffer) readMPMC() (uint64, bool) {
+	for {
+		t := rb.readIdx.Load()
+		slot := &rb.buffer[t%bufferSize]
+		seq := slot.seq.Load()
+		switch {
+		case seq == t+1:
+			if rb.readIdx.CompareAndSwap(t, t+1) {
+				value := slot.val.Load()
+				slot.seq.Store(t + bufferSize)
+				return value, true
+			}
+		case seq < t+1:
+			SpinWait(1 * time.Microsecond) // Buffer empty; wait for a producer to publish
+		default:
+			// Another consumer already claimed this ticket; reload and retry.
+		}
+	}
+}
+
+// atomicWord returns a pointer to the low 32 bits of an atomic.Uint64, which
+// is the word size both parkWait implementations (futex, WaitOnAddress)
+// compare against. Valid on the little-endian architectures this package
+// targets (amd64, arm64).
+func atomicWord(u *atomic.Uint64) *int32 {
+	return (*int32)(unsafe.Pointer(u))
+}
+
+// WriteBlocking writes a value like Write, but parks the calling goroutine
+// (via parkWait) instead of busy-spinning once it has spun for
+// spinBeforePark without the consumer freeing a slot. It wakes any reader
+// parked in ReadBlocking once the value is published. t is reloaded from
+// writeIdx on every iteration, not just after a failed CAS: in MPMC mode a
+// goroutine that fell behind could otherwise keep comparing a stale,
+// already-consumed ticket against the current slot.seq forever, mistaking
+// "someone else already took this ticket" for "buffer still full" and
+// parking on a wait nothing will ever satisfy.
+func (rb *SharedAtomicRingBuffer) WriteBlocking(value uint64) bool {
+	for {
+		t := rb.writeIdx.Load()
+		slot := &rb.buffer[t%bufferSize]
+		seq := slot.seq.Load()
+		switch {
+		case seq == t:
+			if rb.producers > 1 && !rb.writeIdx.CompareAndSwap(t, t+1) {
+				continue // Another producer already claimed this ticket; reload and retry.
+			}
+			slot.val.Store(value)
+			slot.seq.Store(t + 1)
+			if rb.producers <= 1 {
+				rb.writeIdx.Store(t + 1)
+			}
+			parkWake(atomicWord(&rb.writeIdx))
+			return true
+		case seq < t:
+			rb.parkUntilChanged(atomicWord(&rb.readIdx), rb.readIdx.Load()) // Buffer full; wait for a consumer to catch up
+		default:
+			// Another producer already claimed this ticket; reload and retry.
+		}
+	}
+}
+
+// ReadBlocking reads a value like Read, but parks the calling goroutine (via
+// parkWait) instead of busy-spinning once it has spun for spinBeforePark
+// without the producer publishing a slot. It wakes any writer parked in
+// WriteBlocking once the slot is freed. t is reloaded from readIdx on every
+// iteration for the same reason WriteBlocking reloads writeIdx: a stale
+// ticket must never be mistaken for "buffer still empty".
+func (rb *SharedAtomicRingBuffer) ReadBlocking() (uint64, bool) {
+	for {
+		t := rb.readIdx.Load()
+		slot := &rb.buffer[t%bufferSize]
+		seq := slot.seq.Load()
+		switch {
+		case seq == t+1:
+			if rb.consumers > 1 && !rb.readIdx.CompareAndSwap(t, t+1) {
+				continue // Another consumer already claimed this ticket; reload and retry.
+			}
+			value := slot.val.Load()
+			slot.seq.Store(t + bufferSize)
+			if rb.consumers <= 1 {
+				rb.readIdx.Store(t + 1)
+			}
+			parkWake(atomicWord(&rb.readIdx))
+			return value, true
+		case seq < t+1:
+			rb.parkUntilChanged(atomicWord(&rb.writeIdx), rb.writeIdx.Load()) // Buffer empty; wait for a producer to publish
+		default:
+			// Another consumer already claimed this ticket; reload and retry.
+		}
+	}
+}
+
+// parkUntilChanged busy-spins for spinBeforePark, then parks on word via
+// parkWait until it observes a value different from last.
+func (rb *SharedAtomicRingBuffer) parkUntilChanged(word *int32, last uint64) {
+	deadline := time.Now().Add(rb.spinBeforePark)
+	for time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+	parkWait(word, int32(last))
+}
+
+// header returns an atomic view of the 8-byte record header stored at byte
+// offset off within rawBuffer, so the busy/discard bits can be loaded and
+// stored with a single atomic instruction.
+func (rb *SharedAtomicRingBuffer) header(off uint64) *atomic.Uint64 {
+	return (*atomic.Uint64)(unsafe.Pointer(&rb.rawBuffer[off]))
+}
+
+// packHeader combines a payload length and flag bits into the single atomic
+// word that backs struct{ Len uint32; Flags uint32 }.
+func packHeader(length uint32, flags uint64) uint64 {
+	return flags | uint64(length)
+}
+
+// reserve advances rawWriteIdx by total bytes and returns the start offset of
+// the reserved slot. If the slot would straddle the end of rawBuffer, the
+// remainder of the buffer is padded with a discarded slot and reservation
+// retries from the next wrap boundary, mirroring how the eBPF ringbuf avoids
+// splitting a record across the edge of the mapping.
+func (rb *SharedAtomicRingBuffer) reserve(total int) (uint64, error) {
+	if total > rawBufferSize {
+		return 0, fmt.Errorf("sharedmem: record needs %d bytes, exceeds ring capacity %d", total, rawBufferSize)
+	}
+	for {
+		start := rb.rawWriteIdx.Load()
+		off := start % rawBufferSize
+		if int(off)+total > rawBufferSize {
+			pad := rawBufferSize - int(off)
+			if !rb.rawWriteIdx.CompareAndSwap(start, start+uint64(pad)) {
+				continue
+			}
+			if pad >= headerSize {
+				rb.header(off).Store(packHeader(uint32(pad-headerSize), recordDiscard))
+			}
+			continue
+		}
+		if rb.rawWriteIdx.CompareAndSwap(start, start+uint64(total)) {
+			return start, nil
+		}
+	}
+}
+
+// RecordHandle is a reserved, not-yet-visible slot in the variable-length
+// record ring. Exactly one of Commit or Discard must be called to make the
+// slot safe for the reader to pass over.
+type RecordHandle struct {
+	rb  *SharedAtomicRingBuffer
+	off uint64
+	n   int    // Reserved payload length, so Discard can skip the whole slot rather than just its header
+	Buf []byte // Backing storage for the payload; write directly into it before Commit
+}
+
+// Commit clears the busy bit and records the final payload length, publishing
+// the record to the reader.
+func (h *RecordHandle) Commit(n int) {
+	h.rb.header(h.off).Store(packHeader(uint32(n), 0))
+}
+
+// Discard abandons the slot without publishing a payload; the reader skips
+// over it using the Discard flag instead of interpreting partial data. The
+// length field is left as the slot's reserved size (not zeroed) so the
+// reader's skip distance matches what reserve actually carved out of
+// rawBuffer; zeroing it would make ReadRecord skip only a header's worth of
+// bytes and desync from the next real record.
+func (h *RecordHandle) Discard() {
+	h.rb.header(h.off).Store(packHeader(uint32(h.n), recordDiscard))
+}
+
+// ReserveRecord reserves space for an n-byte payload and returns a handle
+// whose Buf field can be written into directly (zero-copy) before calling
+// Commit or Discard.
+func (rb *SharedAtomicRingBuffer) ReserveRecord(n int) (*RecordHandle, error) {
+	size := align8(n + headerSize)
+	start, err := rb.reserve(size)
+	if err != nil {
+		return nil, err
+	}
+	for start+uint64(size)-rb.rawReadIdx.Load() > uint64(rawBufferSize) {
+		SpinWait(5 * time.Microsecond)
+	}
+	off := start % rawBufferSize
+	rb.header(off).Store(packHeader(uint32(n), recordBusy))
+	return &RecordHandle{rb: rb, off: off, n: n, Buf: rb.rawBuffer[off+headerSize : off+headerSize+uint64(n)]}, nil
+}
+
+// WriteRecord reserves a slot, copies payload into it, and commits it in one
+// call. It is the convenience path for producers that already have the bytes
+// in hand; use ReserveRecord directly to fill the slot in place.
+func (rb *SharedAtomicRingBuffer) WriteRecord(payload []byte) error {
+	h, err := rb.ReserveRecord(len(payload))
+	if err != nil {
+		return err
+	}
+	copy(h.Buf, payload)
+	h.Commit(len(payload))
+	return nil
+}
+
+// RecordSample is a variable-length record handed back by ReadRecord.
+type RecordSample struct {
+	RawSample []byte // Points directly into the mapped region; copy it before the slot can be overwritten
+}
+
+// ReadRecord reads the next variable-length record. It returns errBusy if the
+// producer has reserved the slot but not committed it yet (the caller should
+// retry), and errEmpty if the reader has caught up with the writer.
+func (rb *SharedAtomicRingBuffer) ReadRecord() (RecordSample, error) {
+	for {
+		readIdx := rb.rawReadIdx.Load()
+		if readIdx == rb.rawWriteIdx.Load() {
+			return RecordSample{}, errEmpty
+		}
+		off := readIdx % rawBufferSize
+		h := rb.header(off).Load()
+		if h&recordBusy != 0 {
+			return RecordSample{}, errBusy
+		}
+		length := uint32(h)
+		size := uint64(align8(int(length) + headerSize))
+		if h&recordDiscard != 0 {
+			rb.rawReadIdx.Store(readIdx + size)
+			continue
+		}
+		sample := RecordSample{RawSample: rb.rawBuffer[off+headerSize : off+headerSize+uint64(length)]}
+		rb.rawReadIdx.Store(readIdx + size)
+		return sample, nil
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// newTestRingBuffer builds a SharedAtomicRingBuffer backed by a plain heap
+// allocation instead of an mmap'd file, so the ring protocol can be
+// exercised under `go test -race` without touching the filesystem. An mmap
+// or MapViewOfFile call always hands back a page-aligned (and therefore
+// cache-line-aligned) address; the Go heap allocator makes no such promise,
+// so a little slack is over-allocated here and sliced down to the first
+// cache-line boundary to get the same guarantee assertCacheLineAligned
+// expects of the real constructors.
+func newTestRingBuffer(t *testing.T, opts Options) *SharedAtomicRingBuffer {
+	t.Helper()
+	line := uintptr(cacheLineSize())
+	raw := make([]byte, unsafe.Sizeof(SharedAtomicRingBuffer{})+line)
+	base := uintptr(unsafe.Pointer(&raw[0]))
+	pad := (line - base%line) % line
+	rb := (*SharedAtomicRingBuffer)(unsafe.Pointer(&raw[pad]))
+	if err := assertCacheLineAligned(rb); err != nil {
+		t.Fatalf("test helper failed to align the backing allocation: %v", err)
+	}
+	if opts.Producers < 1 {
+		opts.Producers = 1
+	}
+	if opts.Consumers < 1 {
+		opts.Consumers = 1
+	}
+	if opts.SpinBeforePark <= 0 {
+		opts.SpinBeforePark = defaultSpinBeforePark
+	}
+	rb.producers = opts.Producers
+	rb.consumers = opts.Consumers
+	rb.spinBeforePark = opts.SpinBeforePark
+	for i := range rb.buffer {
+		rb.buffer[i].seq.Store(uint64(i))
+	}
+	return rb
+}
+
+func TestRingBufferSPSCRoundTrip(t *testing.T) {
+	rb := newTestRingBuffer(t, Options{Producers: 1, Consumers: 1})
+	const n = 20000
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			rb.Write(uint64(i))
+		}
+	}()
+	sum := uint64(0)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			v, ok := rb.Read()
+			if !ok {
+				t.Errorf("Read() reported !ok")
+			}
+			sum += v
+		}
+	}()
+	wg.Wait()
+
+	want := uint64(n-1) * uint64(n) / 2
+	if sum != want {
+		t.Fatalf("sum = %d, want %d (a value was lost or duplicated)", sum, want)
+	}
+}
+
+func TestRingBufferMPMCRoundTrip(t *testing.T) {
+	const producers = 4
+	const consumers = 4
+	const perProducer = 5000
+	const total = producers * perProducer
+
+	rb := newTestRingBuffer(t, Options{Producers: producers, Consumers: consumers})
+
+	var writers sync.WaitGroup
+	writers.Add(producers)
+	for p := 0; p < producers; p++ {
+		go func() {
+			defer writers.Done()
+			for i := 0; i < perProducer; i++ {
+				rb.Write(1)
+			}
+		}()
+	}
+
+	results := make(chan uint64, consumers)
+	var readers sync.WaitGroup
+	readers.Add(consumers)
+	for c := 0; c < consumers; c++ {
+		go func() {
+			defer readers.Done()
+			var got uint64
+			for i := 0; i < total/consumers; i++ {
+				v, ok := rb.Read()
+				if !ok {
+					t.Errorf("Read() reported !ok")
+				}
+				got += v
+			}
+			results <- got
+		}()
+	}
+
+	writers.Wait()
+	readers.Wait()
+	close(results)
+
+	var sum uint64
+	for r := range results {
+		sum += r
+	}
+	if sum != total {
+		t.Fatalf("sum = %d, want %d (MPMC ticket protocol lost or duplicated a write)", sum, total)
+	}
+}
+
+func TestRingBufferBlockingRoundTrip(t *testing.T) {
+	rb := newTestRingBuffer(t, Options{Producers: 1, Consumers: 1, SpinBeforePark: time.Microsecond})
+	const n = 2000
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			if !rb.WriteBlocking(uint64(i)) {
+				t.Errorf("WriteBlocking returned false")
+			}
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		v, ok := rb.ReadBlocking()
+		if !ok {
+			t.Fatalf("ReadBlocking returned false")
+		}
+		if v != uint64(i) {
+			t.Fatalf("ReadBlocking() = %d, want %d", v, i)
+		}
+	}
+	<-done
+}
+
+// TestRingBufferBlockingMPMCRoundTrip exercises WriteBlocking/ReadBlocking
+// with more than one participant on each side. parkWake only has a single
+// word (&writeIdx or &readIdx) to wake waiters on, even though multiple
+// goroutines can be parked on it waiting on different slots; if parkWake
+// only woke one of them, the one whose slot actually became ready could be
+// left asleep forever while an irrelevant waiter gets woken, rechecks, and
+// re-parks. Run with -timeout to catch that as a hang rather than a
+// deadlock that silently passes.
+func TestRingBufferBlockingMPMCRoundTrip(t *testing.T) {
+	const producers = 4
+	const consumers = 4
+	const perProducer = 2000
+	const total = producers * perProducer
+
+	rb := newTestRingBuffer(t, Options{Producers: producers, Consumers: consumers, SpinBeforePark: time.Microsecond})
+
+	var writers sync.WaitGroup
+	writers.Add(producers)
+	for p := 0; p < producers; p++ {
+		go func() {
+			defer writers.Done()
+			for i := 0; i < perProducer; i++ {
+				if !rb.WriteBlocking(1) {
+					t.Errorf("WriteBlocking returned false")
+				}
+			}
+		}()
+	}
+
+	results := make(chan uint64, consumers)
+	var readers sync.WaitGroup
+	readers.Add(consumers)
+	for c := 0; c < consumers; c++ {
+		go func() {
+			defer readers.Done()
+			var got uint64
+			for i := 0; i < total/consumers; i++ {
+				v, ok := rb.ReadBlocking()
+				if !ok {
+					t.Errorf("ReadBlocking returned false")
+				}
+				got += v
+			}
+			results <- got
+		}()
+	}
+
+	writers.Wait()
+	readers.Wait()
+	close(results)
+
+	var sum uint64
+	for r := range results {
+		sum += r
+	}
+	if sum != total {
+		t.Fatalf("sum = %d, want %d (a parked waiter was never woken)", sum, total)
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	rb := newTestRingBuffer(t, Options{Producers: 1, Consumers: 1})
+
+	payloads := [][]byte{
+		[]byte("hello"),
+		[]byte(""),
+		[]byte("a slightly longer record to exercise align8 padding"),
+	}
+	for _, p := range payloads {
+		if err := rb.WriteRecord(p); err != nil {
+			t.Fatalf("WriteRecord(%q): %v", p, err)
+		}
+	}
+	for _, want := range payloads {
+		sample, err := rb.ReadRecord()
+		if err != nil {
+			t.Fatalf("ReadRecord(): %v", err)
+		}
+		if string(sample.RawSample) != string(want) {
+			t.Fatalf("ReadRecord() = %q, want %q", sample.RawSample, want)
+		}
+	}
+	if _, err := rb.ReadRecord(); err != errEmpty {
+		t.Fatalf("ReadRecord() on drained ring = %v, want errEmpty", err)
+	}
+}
+
+func TestRecordDiscard(t *testing.T) {
+	rb := newTestRingBuffer(t, Options{Producers: 1, Consumers: 1})
+
+	h, err := rb.ReserveRecord(4)
+	if err != nil {
+		t.Fatalf("ReserveRecord: %v", err)
+	}
+	h.Discard()
+
+	if err := rb.WriteRecord([]byte("kept")); err != nil {
+		t.Fatalf("WriteRecord: %v", err)
+	}
+
+	sample, err := rb.ReadRecord()
+	if err != nil {
+		t.Fatalf("ReadRecord() after discard: %v", err)
+	}
+	if string(sample.RawSample) != "kept" {
+		t.Fatalf("ReadRecord() = %q, want %q (discarded slot should be skipped)", sample.RawSample, "kept")
+	}
+}
@@ -1,90 +1,159 @@
+//go:build linux
+
 package main
 
 import (
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 )
 
-const (
-	bufferSize = 1024 // Size of the ring buffer
-)
-
-// SharedAtomicRingBuffer represents a shared atomic ring buffer
+// SharedAtomicRingBuffer represents a shared atomic ring buffer. Fields are
+// laid out as {buffer, pad, writeIdx, pad, readIdx, pad, rawBuffer, pad,
+// rawWriteIdx, pad, rawReadIdx, pad} so every hot index owns its own cache
+// line: without the padding, writeIdx and readIdx sit 8 bytes apart and
+// every producer store invalidates the consumer's line (and vice versa),
+// which guts SPSC throughput.
 type SharedAtomicRingBuffer struct {
-	buffer   [bufferSize]atomic.Uint64 // Shared buffer
-	writeIdx atomic.Uint64             // Write index
-	readIdx  atomic.Uint64             // Read index
+	buffer   [bufferSize]mpmcSlot // Shared buffer
+	_        CacheLinePad
+	writeIdx atomic.Uint64 // Next write ticket
+	_        uint64CacheLinePad
+	readIdx  atomic.Uint64 // Next read ticket
+	_        CacheLinePad
+
+	rawBuffer [rawBufferSize]byte // Shared region for variable-length records
+	_         uint64CacheLinePad
+	rawWriteIdx atomic.Uint64 // Monotonic byte offset of the next slot to reserve
+	_           uint64CacheLinePad
+	rawReadIdx  atomic.Uint64 // Monotonic byte offset of the next slot to read
+	_           CacheLinePad
+
+	producers      int           // >1 selects the CAS-guarded MPMC protocol for Write
+	consumers      int           // >1 selects the CAS-guarded MPMC protocol for Read
+	spinBeforePark time.Duration // How long WriteBlocking/ReadBlocking spin before parking
 }
 
-// NewSharedAtomicRingBuffer creates a new shared atomic ring buffer
-func NewSharedAtomicRingBuffer(name string) (*SharedAtomicRingBuffer, error) {
+// NewSharedAtomicRingBuffer creates a new shared atomic ring buffer. opts is
+// variadic so existing single-producer/single-consumer callers are unaffected;
+// passing an Options value with Producers or Consumers above 1 switches Write
+// or Read, respectively, into MPMC mode.
+func NewSharedAtomicRingBuffer(name string, opts ...Options) (*SharedAtomicRingBuffer, error) {
+	o := Options{Producers: 1, Consumers: 1}
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Producers < 1 {
+		o.Producers = 1
+	}
+	if o.Consumers < 1 {
+		o.Consumers = 1
+	}
+	if o.SpinBeforePark <= 0 {
+		o.SpinBeforePark = defaultSpinBeforePark
+	}
+
 	// Define the path for the shared memory file
 	shmPath := filepath.Join("/tmp", name) // Use /tmp as a fallback for shared memory
-	file, err := os.OpenFile(shmPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+
+	// O_EXCL makes file creation atomic: exactly one caller across all
+	// processes racing on this name gets ErrExist == false and must seed the
+	// ring, mirroring the windows.ERROR_ALREADY_EXISTS check in
+	// share_mem_win.go. Without it (the previous O_TRUNC-always behavior), a
+	// second process attaching to a ring a first process is already
+	// producing/consuming on would truncate the file and stomp every
+	// in-flight seq counter out from under it.
+	file, err := os.OpenFile(shmPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+	alreadyExists := os.IsExist(err)
+	if alreadyExists {
+		file, err = os.OpenFile(shmPath, os.O_RDWR, 0o666)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open shared memory file: %v", err)
 	}
 	defer file.Close()
 
-	// Set the size of the shared memory file
+	// Set the size of the shared memory file. For an attaching process this
+	// is a no-op (the file is already this size), not a truncation back to
+	// empty.
 	size := unsafe.Sizeof(SharedAtomicRingBuffer{})
 	if err := syscall.Ftruncate(int(file.Fd()), int64(size)); err != nil {
-		os.Remove(shmPath) // Clean up the file if resizing fails
+		if !alreadyExists {
+			os.Remove(shmPath) // Clean up the file we created if resizing fails
+		}
 		return nil, fmt.Errorf("failed to set shared memory size: %v", err)
 	}
 
 	// Map the shared memory file into the process's address space
 	mappedMemory, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 	if err != nil {
-		os.Remove(shmPath) // Clean up the file if mapping fails
+		if !alreadyExists {
+			os.Remove(shmPath) // Clean up the file we created if mapping fails
+		}
 		return nil, fmt.Errorf("failed to map shared memory: %v", err)
 	}
 
 	// Convert the mapped memory to a SharedAtomicRingBuffer
 	ringBuffer := (*SharedAtomicRingBuffer)(unsafe.Pointer(&mappedMemory[0]))
+	if err := assertCacheLineAligned(ringBuffer); err != nil {
+		syscall.Munmap(mappedMemory)
+		if !alreadyExists {
+			os.Remove(shmPath)
+		}
+		return nil, err
+	}
+	// producers/consumers/spinBeforePark live in the shared mapping itself, so
+	// an attaching process must leave them as the creator set them rather than
+	// overwriting them with its own (possibly default) Options: Write/Read
+	// branch on rb.producers/rb.consumers to pick the SPSC or CAS-guarded MPMC
+	// path, and flipping that under a process already mid-flight would let two
+	// producers race on the same slot without the CAS that mode requires.
+	if !alreadyExists {
+		ringBuffer.producers = o.Producers
+		ringBuffer.consumers = o.Consumers
+		ringBuffer.spinBeforePark = o.SpinBeforePark
+		// O_EXCL above guarantees this process owns a freshly zeroed mapping,
+		// so it's always safe (and necessary) to seed each slot's sequence
+		// number.
+		for i := range ringBuffer.buffer {
+			ringBuffer.buffer[i].seq.Store(uint64(i))
+		}
+	}
 	return ringBuffer, nil
 }
 
-// SpinWait performs a low-latency CPU spin loop for the given duration
-func SpinWait(duration time.Duration) {
-	start := time.Now()
-	for time.Since(start) < duration {
-		runtime.Gosched() // Yield CPU to reduce contention
-	}
-}
+// Linux futex(2) operation codes used against the shared writeIdx/readIdx
+// words; not exported by the syscall package, so declared locally.
+const (
+	futexWaitOp = 0
+	futexWakeOp = 1
+)
 
-// Write writes a value to the ring buffer
-func (rb *SharedAtomicRingBuffer) Write(value uint64) bool {
-	writeIdx := rb.writeIdx.Load()
-	nextWriteIdx := (writeIdx + 1) % bufferSize
-	// Check if the buffer is full
-	for nextWriteIdx == rb.readIdx.Load() {
-		SpinWait(5 * time.Microsecond)
+// parkWait blocks until *word no longer equals expect, or until woken by
+// parkWake on the same address.
+func parkWait(word *int32, expect int32) {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(word)), futexWaitOp, uintptr(expect), 0, 0, 0)
+	if errno != 0 && errno != syscall.EAGAIN && errno != syscall.EINTR {
+		// Fall back to a short sleep rather than spinning forever on an
+		// unexpected errno (e.g. ENOSYS on a kernel built without futexes).
+		time.Sleep(time.Microsecond)
 	}
-	// Write the value
-	rb.buffer[writeIdx].Store(value)
-	rb.writeIdx.Store(nextWriteIdx)
-	return true
 }
 
-// Read reads a value from the ring buffer
-func (rb *SharedAtomicRingBuffer) Read() (uint64, bool) {
-	readIdx := rb.readIdx.Load()
-	// Check if the buffer is empty
-	for readIdx == rb.writeIdx.Load() {
-		SpinWait(1 * time.Microsecond)
-	}
-	// Read the value
-	value := rb.buffer[readIdx].Load()
-	rb.readIdx.Store((readIdx + 1) % bufferSize)
-	return value, true
+// parkWake wakes every waiter parked on word via parkWait. In MPMC mode,
+// multiple goroutines can be parked on the same word (&writeIdx or &readIdx)
+// waiting on different slots becoming ready; waking only one leaves the
+// rest asleep on an arbitrary, possibly-wrong guess of who should proceed,
+// which can hang forever. math.MaxInt32 as the count is the standard
+// FUTEX_WAKE idiom for "wake everyone".
+func parkWake(word *int32) {
+	syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(word)), futexWakeOp, math.MaxInt32, 0, 0, 0)
 }
 
 func main() {
@@ -116,4 +185,3 @@ func main() {
 	// Wait for the producer to finish
 	time.Sleep(2 * time.Second)
 }
-